@@ -39,18 +39,16 @@ func (s *StandAloneStorage) Reader(ctx *kvrpcpb.Context) (storage.StorageReader,
 
 func (s *StandAloneStorage) Write(ctx *kvrpcpb.Context, batch []storage.Modify) error {
 	// Your Code Here (1).
-	txn := s.db.NewTransaction(true)
-	var err error = nil
-	switch batch[0].Data.(type) {
-	case storage.Put:
-		err = txn.Set(engine_util.KeyWithCF(batch[0].Cf(), batch[0].Key()), batch[0].Value())
-	case storage.Delete:
-		err = txn.Delete(engine_util.KeyWithCF(batch[0].Cf(), batch[0].Key()))
+	wb := new(engine_util.WriteBatch)
+	for _, m := range batch {
+		switch data := m.Data.(type) {
+		case storage.Put:
+			wb.SetCF(data.Cf, data.Key, data.Value)
+		case storage.Delete:
+			wb.DeleteCF(data.Cf, data.Key)
+		}
 	}
-	if err != nil {
-		return err
-	}
-	return txn.Commit()
+	return wb.WriteToDB(s.db)
 }
 
 type StandAloneStorageReader struct {
@@ -74,5 +72,5 @@ func (sr *StandAloneStorageReader) IterCF(cf string) engine_util.DBIterator {
 }
 
 func (sr *StandAloneStorageReader) Close() {
-	sr.Txn.Commit()
+	sr.Txn.Discard()
 }
\ No newline at end of file
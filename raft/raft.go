@@ -30,12 +30,14 @@ type StateType uint64
 const (
 	StateFollower StateType = iota
 	StateCandidate
+	StatePreCandidate
 	StateLeader
 )
 
 var stmap = [...]string{
 	"StateFollower",
 	"StateCandidate",
+	"StatePreCandidate",
 	"StateLeader",
 }
 
@@ -47,6 +49,56 @@ func (st StateType) String() string {
 // so that the proposer can be notified and fail fast.
 var ErrProposalDropped = errors.New("raft proposal dropped")
 
+// ConfChangeType enumerates the single-node transitions a ConfChangeV2 may bundle.
+type ConfChangeType int
+
+const (
+	ConfChangeAddNode ConfChangeType = iota
+	ConfChangeAddLearnerNode
+	ConfChangeRemoveNode
+	ConfChangePromoteLearner
+)
+
+// ConfChangeTransition selects how a ConfChangeV2 leaves the joint
+// configuration it enters while being applied.
+type ConfChangeTransition int
+
+const (
+	// ConfChangeTransitionAuto leaves the joint configuration automatically
+	// as soon as the entry is applied, with no intermediate state visible to
+	// the caller. Safe for any single change, and what the one-shot
+	// addNode/removeNode-style callers should use.
+	ConfChangeTransitionAuto ConfChangeTransition = iota
+	// ConfChangeTransitionExplicit leaves the joint configuration only once
+	// the leader proposes and commits a follow-up, empty ConfChangeV2.
+	// Required for changes a single step could not survive a crash in the
+	// middle of, e.g. swapping a majority of voters in one go.
+	ConfChangeTransitionExplicit
+)
+
+// ConfChangeSingle describes one member-list transition bundled inside a ConfChangeV2.
+type ConfChangeSingle struct {
+	Type   ConfChangeType
+	NodeID uint64
+}
+
+// ConfChangeV2 is a (possibly multi-change) membership change entry, applied
+// through joint consensus so the cluster is never without a quorum partway
+// through the change. An empty ConfChangeV2 (no Changes) applied while
+// already joint leaves the joint configuration.
+type ConfChangeV2 struct {
+	Transition ConfChangeTransition
+	Changes    []ConfChangeSingle
+}
+
+// ConfState describes a raft group's membership: the voters, the learners,
+// and, while a joint-consensus change is in flight, the outgoing voters.
+type ConfState struct {
+	Voters         []uint64
+	VotersOutgoing []uint64
+	Learners       []uint64
+}
+
 // Config contains the parameters to start a raft.
 type Config struct {
 	// ID is the identity of the local raft. ID cannot be 0.
@@ -80,8 +132,58 @@ type Config struct {
 	// Applied. If Applied is unset when restarting, raft might return previous
 	// applied entries. This is a very application dependent configuration.
 	Applied uint64
+
+	// learners contains the IDs of nodes that should be started as learners
+	// (non-voting members). Like peers, it should only be set when starting a
+	// new raft cluster.
+	learners []uint64
+
+	// PreVote enables the pre-vote algorithm described in raft thesis section
+	// 9.6. This prevents disruption when a node that has been partitioned away
+	// rejoins the cluster: instead of bumping its term and forcing a real
+	// election straight away, the node first canvasses the cluster to check it
+	// could actually win an election before doing so.
+	PreVote bool
+
+	// CheckQuorum specifies if the leader should check quorum activity every
+	// election timeout. If it fails to hear from a quorum of peers during that
+	// interval, it steps down to Follower. It also lets the leader reject votes
+	// while it still believes it holds a live quorum, avoiding unnecessary
+	// elections caused by a flapping minority partition.
+	CheckQuorum bool
+
+	// MaxInflightMsgs limits the number of in-flight append messages a leader
+	// may have outstanding to a single follower once that follower is caught
+	// up (ProgressStateReplicate). Once this limit is reached, sendAppend to
+	// that follower is a no-op until an ack frees up room in the window.
+	// 0 defaults to 256.
+	MaxInflightMsgs int
+
+	// MaxSizePerMsg limits the aggregate size of the entries carried by a
+	// single MsgAppend, in bytes. 0 means no limit.
+	MaxSizePerMsg uint64
+
+	// ReadOnlyOption controls how a leader serves a linearizable read-only
+	// query. See the ReadOnly* constants.
+	ReadOnlyOption ReadOnlyOption
 }
 
+// ReadOnlyOption controls how Raft.Step(MsgReadIndex) is served by the
+// leader.
+type ReadOnlyOption int
+
+const (
+	// ReadOnlySafe confirms the read index with a round of heartbeats before
+	// serving it, guaranteeing linearizability even if this node has since
+	// been superseded by another leader.
+	ReadOnlySafe ReadOnlyOption = iota
+	// ReadOnlyLeaseBased skips the heartbeat round-trip and answers
+	// immediately off the leader's lease. It is only safe to use alongside
+	// CheckQuorum, and trades a small linearizability risk (under clock
+	// drift) for lower read latency.
+	ReadOnlyLeaseBased
+)
+
 func (c *Config) validate() error {
 	if c.ID == None {
 		return errors.New("cannot use none as id")
@@ -102,10 +204,343 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// ProgressStateType represents how a leader is currently replicating to a
+// given follower.
+type ProgressStateType uint64
+
+const (
+	// ProgressStateProbe is the initial state for a follower the leader is
+	// unsure about: at most one MsgAppend is kept outstanding at a time, and
+	// further sends are paused until a response arrives.
+	ProgressStateProbe ProgressStateType = iota
+	// ProgressStateReplicate is entered once a follower has acked an append:
+	// the leader may pipeline up to MaxInflightMsgs batches without waiting
+	// for each one to be acked.
+	ProgressStateReplicate
+	// ProgressStateSnapshot is entered when the leader has had to send a
+	// snapshot because the entries the follower needs are no longer
+	// available; no further appends are sent until the snapshot lands.
+	ProgressStateSnapshot
+)
+
+var prstmap = [...]string{
+	"ProgressStateProbe",
+	"ProgressStateReplicate",
+	"ProgressStateSnapshot",
+}
+
+func (st ProgressStateType) String() string {
+	return prstmap[uint64(st)]
+}
+
 // Progress represents a follower’s progress in the view of the leader. Leader maintains
 // progresses of all followers, and sends entries to the follower based on its progress.
 type Progress struct {
 	Match, Next uint64
+
+	// State governs how sendAppend paces messages to this follower. See the
+	// ProgressState* constants.
+	State ProgressStateType
+	// Paused is only meaningful in ProgressStateProbe: it is set once a probe
+	// MsgAppend is sent and cleared on the next response, so that at most one
+	// probe is outstanding at a time.
+	Paused bool
+	// PendingSnapshot is the index of the snapshot last sent to this
+	// follower. It is cleared once the follower's Match passes it.
+	PendingSnapshot uint64
+
+	// ins holds the indexes of the MsgAppend batches sent while in
+	// ProgressStateReplicate that have not been acked yet, bounding how far
+	// the leader may pipeline ahead of this follower.
+	ins *inflights
+
+	// RecentActive is true if the follower has answered to this leader during
+	// the current election interval. It is reset to false at the start of each
+	// interval and is used by CheckQuorum to detect a leader that has lost
+	// contact with a quorum of the cluster.
+	RecentActive bool
+}
+
+// resetState clears a Progress back to the given state, dropping any paused
+// or in-flight bookkeeping from the previous state.
+func (pr *Progress) resetState(state ProgressStateType) {
+	pr.Paused = false
+	pr.PendingSnapshot = 0
+	pr.State = state
+	pr.ins.reset()
+}
+
+// becomeProbe transitions to ProgressStateProbe. If the follower was in
+// ProgressStateSnapshot, Next resumes just after the snapshot so the leader
+// does not resend entries the snapshot already covered.
+func (pr *Progress) becomeProbe() {
+	if pr.State == ProgressStateSnapshot {
+		pending := pr.PendingSnapshot
+		pr.resetState(ProgressStateProbe)
+		pr.Next = max(pr.Match+1, pending+1)
+		return
+	}
+	pr.resetState(ProgressStateProbe)
+	pr.Next = pr.Match + 1
+}
+
+// becomeReplicate transitions to ProgressStateReplicate, resuming pipelined
+// sends right after the last matched entry.
+func (pr *Progress) becomeReplicate() {
+	pr.resetState(ProgressStateReplicate)
+	pr.Next = pr.Match + 1
+}
+
+// becomeSnapshot transitions to ProgressStateSnapshot: no further appends
+// are sent until the follower acks having applied the snapshot at
+// snapshotIndex.
+func (pr *Progress) becomeSnapshot(snapshotIndex uint64) {
+	pr.resetState(ProgressStateSnapshot)
+	pr.PendingSnapshot = snapshotIndex
+}
+
+// maybeUpdate reports that entries up to index n have been acked by the
+// follower. It advances Match/Next and returns whether anything changed.
+func (pr *Progress) maybeUpdate(n uint64) bool {
+	if pr.Match >= n {
+		return false
+	}
+	pr.Match = n
+	if pr.Next < n+1 {
+		pr.Next = n + 1
+	}
+	return true
+}
+
+// maybeDecrTo backs Next off after a rejected append, using the follower's
+// hint (the index its log actually ends at) to jump back directly instead of
+// retrying one entry at a time. Returns whether Next was changed.
+func (pr *Progress) maybeDecrTo(hint uint64) bool {
+	if pr.State == ProgressStateReplicate {
+		pr.becomeProbe()
+	}
+	next := hint + 1
+	if next >= pr.Next {
+		if pr.Next <= 1 {
+			return false
+		}
+		next = pr.Next - 1
+	}
+	pr.Next = next
+	pr.Paused = false
+	return true
+}
+
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// uint64Slice attaches sort.Interface to []uint64, sorted ascending, so a
+// quorum's match indexes can find their median.
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// medianMatch returns the Match index such that a majority of prs have
+// matched at least that far — the value a leader belonging to this set could
+// safely advance its commit index to. Returns 0 for an empty set.
+func medianMatch(prs map[uint64]*Progress) uint64 {
+	if len(prs) == 0 {
+		return 0
+	}
+	match := make(uint64Slice, len(prs))
+	i := 0
+	for _, pr := range prs {
+		match[i] = pr.Match
+		i++
+	}
+	sort.Sort(match)
+	return match[(len(match)-1)/2]
+}
+
+// inflights is a bounded ring buffer of the log indexes carried by MsgAppend
+// batches that a leader has sent to a ProgressStateReplicate follower but not
+// yet seen acked, used to cap how far ahead of that follower the leader may
+// pipeline.
+type inflights struct {
+	start int
+	count int
+
+	size int
+
+	buffer []uint64
+}
+
+// newInflights builds an inflights that can track up to size in-flight
+// batches.
+func newInflights(size int) *inflights {
+	return &inflights{
+		size: size,
+	}
+}
+
+// add records that a batch ending at the given index is now in flight.
+func (in *inflights) add(inflight uint64) {
+	if in.full() {
+		panic("cannot add into a full inflights")
+	}
+	next := in.start + in.count
+	if next >= in.size {
+		next -= in.size
+	}
+	if next >= len(in.buffer) {
+		in.grow()
+	}
+	in.buffer[next] = inflight
+	in.count++
+}
+
+// grow doubles the backing array, capped at size.
+func (in *inflights) grow() {
+	newSize := len(in.buffer) * 2
+	if newSize == 0 {
+		newSize = 1
+	} else if newSize > in.size {
+		newSize = in.size
+	}
+	newBuffer := make([]uint64, newSize)
+	copy(newBuffer, in.buffer)
+	in.buffer = newBuffer
+}
+
+// freeTo frees every in-flight batch up to and including the one ending at
+// index to, sliding the window forward as acks arrive.
+func (in *inflights) freeTo(to uint64) {
+	if in.count == 0 || to < in.buffer[in.start] {
+		return
+	}
+	i, idx := 0, in.start
+	for ; i < in.count; i++ {
+		if to < in.buffer[idx] {
+			break
+		}
+		size := in.size
+		idx++
+		if idx >= size {
+			idx -= size
+		}
+	}
+	in.count -= i
+	in.start = idx
+	if in.count == 0 {
+		in.start = 0
+	}
+}
+
+// full reports whether size in-flight batches are already outstanding.
+func (in *inflights) full() bool {
+	return in.count == in.size
+}
+
+// reset drops every tracked in-flight batch.
+func (in *inflights) reset() {
+	in.count = 0
+	in.start = 0
+}
+
+// ReadState is surfaced to the application (via RawNode's Ready) once Index
+// is known to be safely readable: Index is the commit index the leader
+// confirmed for the request, and the query is linearizable once the
+// application has applied every entry up to Index. RequestCtx lets the
+// caller match it back to the MsgReadIndex it issued.
+type ReadState struct {
+	Index      uint64
+	RequestCtx []byte
+}
+
+// readIndexStatus tracks the leader's progress confirming a single read
+// index request: which peers have acked it via heartbeat, and the original
+// request (so the reply can be routed back to whoever asked, local or
+// forwarded).
+type readIndexStatus struct {
+	req   pb.Message
+	index uint64
+	acks  map[uint64]bool
+}
+
+// readOnly batches pending ReadIndex requests by their (unique) context and
+// confirms them in the order they were requested once a quorum of heartbeat
+// responses echo the same context back.
+type readOnly struct {
+	option           ReadOnlyOption
+	pendingReadIndex map[string]*readIndexStatus
+	readIndexQueue   []string
+}
+
+func newReadOnly(option ReadOnlyOption) *readOnly {
+	return &readOnly{
+		option:           option,
+		pendingReadIndex: make(map[string]*readIndexStatus),
+	}
+}
+
+// addRequest queues m (a MsgReadIndex) as pending at read index index until
+// a quorum acks it, keyed by the context carried in its first entry.
+func (ro *readOnly) addRequest(index uint64, m pb.Message) {
+	ctx := string(m.Entries[0].Data)
+	if _, ok := ro.pendingReadIndex[ctx]; ok {
+		return
+	}
+	ro.pendingReadIndex[ctx] = &readIndexStatus{req: m, index: index, acks: make(map[uint64]bool)}
+	ro.readIndexQueue = append(ro.readIndexQueue, ctx)
+}
+
+// recvAck records that id's heartbeat response echoed ctx, returning the
+// full ack set gathered for it so far (nil if ctx is unknown).
+func (ro *readOnly) recvAck(id uint64, ctx []byte) map[uint64]bool {
+	rs, ok := ro.pendingReadIndex[string(ctx)]
+	if !ok {
+		return nil
+	}
+	rs.acks[id] = true
+	return rs.acks
+}
+
+// advance pops every pending request up to and including ctx off the queue
+// once ctx reaches quorum, since an earlier-issued read is confirmed by the
+// same (or an even later) committed index.
+func (ro *readOnly) advance(ctx []byte) []*readIndexStatus {
+	var rss []*readIndexStatus
+	i, found := 0, false
+	for _, c := range ro.readIndexQueue {
+		i++
+		rs, ok := ro.pendingReadIndex[c]
+		if !ok {
+			panic("cannot find corresponding read state from pending map")
+		}
+		rss = append(rss, rs)
+		if c == string(ctx) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	ro.readIndexQueue = ro.readIndexQueue[i:]
+	for _, rs := range rss {
+		delete(ro.pendingReadIndex, string(rs.req.Entries[0].Data))
+	}
+	return rss
+}
+
+// lastPendingRequestCtx returns the context of the most recently queued
+// request, or nil if there is none.
+func (ro *readOnly) lastPendingRequestCtx() []byte {
+	if len(ro.readIndexQueue) == 0 {
+		return nil
+	}
+	return []byte(ro.readIndexQueue[len(ro.readIndexQueue)-1])
 }
 
 type Raft struct {
@@ -120,6 +555,15 @@ type Raft struct {
 	// log replication progress of each peers
 	Prs map[uint64]*Progress
 
+	// log replication progress of each learner (non-voting member). Learners
+	// receive MsgAppend/MsgHeartbeat and report MsgAppendResponse exactly like
+	// voters, but are never counted towards a quorum.
+	LearnerPrs map[uint64]*Progress
+
+	// isLearner is true when the local node itself is a learner. A learner
+	// never campaigns: it ignores MsgHup and cannot become a candidate.
+	isLearner bool
+
 	// this peer's role
 	State StateType
 
@@ -157,6 +601,35 @@ type Raft struct {
 	// value.
 	// (Used in 3A conf change)
 	PendingConfIndex uint64
+
+	// PreVote enables the pre-vote algorithm before a real election is started.
+	// See Config.PreVote.
+	PreVote bool
+
+	// CheckQuorum enables the leader-activity checks described on Config.CheckQuorum.
+	CheckQuorum bool
+
+	// maxInflightMsgs and maxMsgSize mirror Config.MaxInflightMsgs and
+	// Config.MaxSizePerMsg; they size every Progress's inflights window and
+	// cap how much sendAppend batches per message.
+	maxInflightMsgs int
+	maxMsgSize      uint64
+
+	// readOnly tracks read index requests awaiting heartbeat confirmation
+	// from a quorum of peers. See Config.ReadOnlyOption.
+	readOnly *readOnly
+
+	// readStates holds ReadState values ready to be drained into Ready() by
+	// RawNode, in the order their read index was confirmed.
+	readStates []ReadState
+
+	// votersOutgoing holds the outgoing (pre-change) voter set's Progress
+	// while a joint-consensus ConfChangeV2 is in flight; nil outside of a
+	// joint configuration. An id that remains a voter in the incoming set
+	// points at the same *Progress as Prs; an id being removed keeps its own
+	// Progress here until the joint state is left, so it keeps replicating
+	// and voting as part of the old majority until it is no longer needed.
+	votersOutgoing map[uint64]*Progress
 }
 
 // newRaft return a raft peer with the given config
@@ -165,10 +638,22 @@ func newRaft(c *Config) *Raft {
 		panic(err.Error())
 	}
 	// Your Code Here (2A).
+	maxInflight := c.MaxInflightMsgs
+	if maxInflight <= 0 {
+		maxInflight = 256
+	}
 	prs := make(map[uint64]*Progress, len(c.peers))
 	vt := make(map[uint64]bool, len(c.peers))
 	for i := 0; i < len(c.peers); i++ {
-		prs[c.peers[i]] = &Progress{}
+		prs[c.peers[i]] = &Progress{Next: 1, ins: newInflights(maxInflight)}
+	}
+	learnerPrs := make(map[uint64]*Progress, len(c.learners))
+	isLearner := false
+	for i := 0; i < len(c.learners); i++ {
+		learnerPrs[c.learners[i]] = &Progress{Next: 1, ins: newInflights(maxInflight)}
+		if c.learners[i] == c.ID {
+			isLearner = true
+		}
 	}
 	r := &Raft{
 		id: c.ID,
@@ -178,44 +663,152 @@ func newRaft(c *Config) *Raft {
 		electionTimeout: c.ElectionTick,
 		heartbeatTimeout: c.HeartbeatTick,
 		Prs: prs,
+		LearnerPrs: learnerPrs,
+		isLearner: isLearner,
 		votes: vt,
+		PreVote: c.PreVote,
+		CheckQuorum: c.CheckQuorum,
+		maxInflightMsgs: maxInflight,
+		maxMsgSize: c.MaxSizePerMsg,
+		readOnly: newReadOnly(c.ReadOnlyOption),
 	}
 	r.initTimer()
 	return r
 }
 
+// quorum returns the size of a majority of the incoming voting group.
+// Learners are never part of the voting group. While a joint-consensus
+// change is in flight, a majority of the outgoing group is also required;
+// see committedIndex and handleVoteResponse.
+func (r *Raft) quorum() int {
+	return len(r.Prs)/2 + 1
+}
+
+// isJoint reports whether a joint-consensus ConfChangeV2 is currently in
+// flight, i.e. whether there is a separate outgoing voter set.
+func (r *Raft) isJoint() bool {
+	return len(r.votersOutgoing) > 0
+}
+
+// allVoterIDs returns every id that must be sent appends/heartbeats and
+// consulted for quorum: the incoming voter set, plus the outgoing voter set
+// while a joint-consensus change is in flight.
+func (r *Raft) allVoterIDs() []uint64 {
+	ids := make([]uint64, 0, len(r.Prs)+len(r.votersOutgoing))
+	for id := range r.Prs {
+		ids = append(ids, id)
+	}
+	for id := range r.votersOutgoing {
+		if _, ok := r.Prs[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// progress returns the Progress tracked for id, whether it is an incoming
+// voter, an outgoing voter kept alive by a joint-consensus change, or a
+// learner, or nil if id is not a member of this raft group.
+func (r *Raft) progress(id uint64) *Progress {
+	if pr, ok := r.Prs[id]; ok {
+		return pr
+	}
+	if pr, ok := r.votersOutgoing[id]; ok {
+		return pr
+	}
+	return r.LearnerPrs[id]
+}
+
+// committedIndex returns the index a leader in this configuration may safely
+// advance its commit index to: the median Match of the incoming voters, or,
+// while a joint-consensus change is in flight, the smaller of that and the
+// median Match of the outgoing voters (a majority of both sets is required).
+func (r *Raft) committedIndex() uint64 {
+	committed := medianMatch(r.Prs)
+	if r.isJoint() {
+		if out := medianMatch(r.votersOutgoing); out < committed {
+			committed = out
+		}
+	}
+	return committed
+}
+
+// maybeAdvanceCommitted advances r.RaftLog.committed to committedIndex() if
+// that is further along, when we are the leader.
+func (r *Raft) maybeAdvanceCommitted() {
+	if r.State != StateLeader {
+		return
+	}
+	if committed := r.committedIndex(); committed > r.RaftLog.committed {
+		r.RaftLog.committed = committed
+	}
+}
+
 // sendAppend sends an append RPC with new entries (if any) and the
 // current commit index to the given peer. Returns true if a message was sent.
 func (r *Raft) sendAppend(to uint64) bool {
 	// Your Code Here (2A).
+	pr := r.progress(to)
+	if pr == nil {
+		return false
+	}
+	if pr.State == ProgressStateSnapshot {
+		return false
+	}
+	if pr.State == ProgressStateProbe && pr.Paused {
+		return false
+	}
+	if pr.State == ProgressStateReplicate && pr.ins.full() {
+		return false
+	}
+
+	logTerm, err := r.RaftLog.Term(pr.Next - 1)
+	if err != nil {
+		// The entries pr.Next needs have already been compacted away, so an
+		// append can't be built. Sending a snapshot instead is not yet
+		// implemented (see handleSnapshot); for now just decline to send.
+		return false
+	}
 	var ents []*pb.Entry
-	for i := r.Prs[to].Match; i < uint64(len(r.RaftLog.entries)); i++ {
-		//if r.RaftLog.entries[i].Data == nil {
-		//	r.Prs[to].Match++
-		//	continue
-		//}
-		ents = append(ents, &r.RaftLog.entries[i])
+	var size uint64
+	for i := pr.Next - 1; i < uint64(len(r.RaftLog.entries)); i++ {
+		e := &r.RaftLog.entries[i]
+		if r.maxMsgSize > 0 && len(ents) > 0 && size+uint64(len(e.Data)) > r.maxMsgSize {
+			break
+		}
+		ents = append(ents, e)
+		size += uint64(len(e.Data))
 	}
 	if len(ents) == 0 {
 		return false
 	}
-	logTerm, _ := r.RaftLog.Term(r.Prs[to].Match)
 	msg := pb.Message {
 		MsgType: pb.MessageType_MsgAppend,
 		To: to,
 		From: r.id,
 		Term: r.Term,
 		LogTerm: logTerm,
-		Index: r.Prs[to].Match,
+		Index: pr.Next - 1,
 		Entries: ents,
 		Commit: r.RaftLog.committed,
 	}
 	r.msgs = append(r.msgs, msg)
+
+	switch pr.State {
+	case ProgressStateProbe:
+		pr.Paused = true
+	case ProgressStateReplicate:
+		last := ents[len(ents)-1].Index
+		pr.Next = last + 1
+		pr.ins.add(last)
+	}
 	return true
 }
 
-// sendHeartbeat sends a heartbeat RPC to the given peer.
-func (r *Raft) sendHeartbeat(to uint64) {
+// sendHeartbeat sends a heartbeat RPC to the given peer. ctx, when non-nil,
+// is a pending ReadIndex request's context: the follower echoes it back on
+// its MsgHeartbeatResponse so the leader can tell which read(s) it confirms.
+func (r *Raft) sendHeartbeat(to uint64, ctx []byte) {
 	// Your Code Here (2A).
 	msg := pb.Message {
 		MsgType: pb.MessageType_MsgHeartbeat,
@@ -225,6 +818,9 @@ func (r *Raft) sendHeartbeat(to uint64) {
 		LogTerm: 0,
 		Index: 0,
 	}
+	if ctx != nil {
+		msg.Entries = []*pb.Entry{{Data: ctx}}
+	}
 	if to == r.id {
 		r.Step(msg)
 	} else {
@@ -232,25 +828,39 @@ func (r *Raft) sendHeartbeat(to uint64) {
 	}
 }
 
-func (r *Raft) sendRequestVote(to uint64) {
+// sendRequestVote sends a MsgRequestVote or, when preVote is set, a
+// MsgPreVote RPC to the given peer. A pre-vote is sent with Term+1 without
+// actually bumping r.Term, since the local node has not committed to
+// starting a real election yet.
+func (r *Raft) sendRequestVote(to uint64, preVote bool) {
 	// Your Code Here (2A).
 	index := r.RaftLog.LastIndex()
 	logTerm, _ := r.RaftLog.Term(index)
+	term := r.Term
+	msgType := pb.MessageType_MsgRequestVote
+	if preVote {
+		term = r.Term + 1
+		msgType = pb.MessageType_MsgPreVote
+	}
 	msg := pb.Message {
-		MsgType: pb.MessageType_MsgRequestVote,
+		MsgType: msgType,
 		To: to,
 		From: r.id,
-		Term: r.Term,
+		Term: term,
 		LogTerm: logTerm,
 		Index: index,
 	}
 	r.msgs = append(r.msgs, msg)
 }
 
-func (r *Raft) sendRequestVoteResponse(to uint64, reject bool) {
+func (r *Raft) sendRequestVoteResponse(to uint64, preVote bool, reject bool) {
 	// Your Code Here (2A).
+	msgType := pb.MessageType_MsgRequestVoteResponse
+	if preVote {
+		msgType = pb.MessageType_MsgPreVoteResponse
+	}
 	msg := pb.Message {
-		MsgType: pb.MessageType_MsgRequestVoteResponse,
+		MsgType: msgType,
 		To: to,
 		From: r.id,
 		Term: r.Term,
@@ -265,6 +875,7 @@ func (r *Raft) tick() {
 	switch r.State {
 	case StateLeader:
 		r.heartbeatElapsed++
+		r.electionElapsed++
 		if r.heartbeatElapsed >= r.heartbeatTimeout {
 			r.heartbeatElapsed = 0
 			r.Step(pb.Message {
@@ -276,8 +887,14 @@ func (r *Raft) tick() {
 				Index: 0,
 			})
 		}
+		if r.CheckQuorum && r.electionElapsed >= r.electionTimeout {
+			r.electionElapsed = 0
+			r.checkQuorumActive()
+		}
 	case StateFollower:
 		fallthrough
+	case StatePreCandidate:
+		fallthrough
 	case StateCandidate:
 		r.electionElapsed++
 		if r.electionElapsed >= r.currentElectionTimeout {
@@ -298,6 +915,18 @@ func (r *Raft) becomeFollower(term uint64, lead uint64) {
 	r.State = StateFollower
 	r.Term = term
 	r.Lead = lead
+	r.Vote = None
+	r.initTimer()
+}
+
+// becomePreCandidate transforms this peer's state to PreCandidate. Unlike
+// becomeCandidate, it does not bump Term or persist Vote: a pre-candidate is
+// only canvassing the cluster to see whether it could win a real election.
+func (r *Raft) becomePreCandidate() {
+	r.State = StatePreCandidate
+	r.Lead = None
+	r.votes = make(map[uint64]bool)
+	r.votes[r.id] = true
 	r.initTimer()
 }
 
@@ -306,8 +935,10 @@ func (r *Raft) becomeCandidate() {
 	// Your Code Here (2A).
 	r.State = StateCandidate
 	r.Term++
+	r.Vote = r.id
+	r.Lead = None
 	r.votes = make(map[uint64]bool)
-	r.VotedFrom(r.id)
+	r.votes[r.id] = true
 	r.initTimer()
 }
 
@@ -316,6 +947,27 @@ func (r *Raft) becomeLeader() {
 	// Your Code Here (2A).
 	// NOTE: Leader should propose a noop entry on its term
 	r.State = StateLeader
+	r.Lead = r.id
+	lastIndex := r.RaftLog.LastIndex()
+	for _, id := range r.allVoterIDs() {
+		pr := r.progress(id)
+		pr.RecentActive = id == r.id
+		pr.Match = 0
+		pr.Next = lastIndex + 1
+		pr.resetState(ProgressStateProbe)
+		if id == r.id {
+			// The leader's own entries are always matched: it never sends
+			// itself an append and waits on a response.
+			pr.Match = lastIndex
+			pr.State = ProgressStateReplicate
+		}
+	}
+	for _, pr := range r.LearnerPrs {
+		pr.RecentActive = false
+		pr.Match = 0
+		pr.Next = lastIndex + 1
+		pr.resetState(ProgressStateProbe)
+	}
 	noop := pb.Entry {
 		Term: r.Term,
 		Index: r.RaftLog.LastIndex() + 1,
@@ -332,10 +984,173 @@ func (r *Raft) becomeLeader() {
 	r.initTimer()
 }
 
-func (r *Raft) VotedFrom(from uint64) {
-	r.votes[from] = true
-	if len(r.votes) > len(r.Prs) / 2 {
-		r.becomeLeader()
+// campaign starts a new election, or a pre-vote round if preVote is set. If
+// the local node is the only voter, it wins immediately (a pre-vote round
+// still falls through to a real election in that case, since there is no
+// other peer to ask).
+func (r *Raft) campaign(preVote bool) {
+	if preVote {
+		r.becomePreCandidate()
+	} else {
+		r.becomeCandidate()
+	}
+	if !r.isJoint() && r.quorum() == len(r.votes) {
+		// Single voter cluster: we already have our own vote.
+		if preVote {
+			r.campaign(false)
+		} else {
+			r.becomeLeader()
+		}
+		return
+	}
+	for _, id := range r.allVoterIDs() {
+		if id == r.id {
+			continue
+		}
+		r.sendRequestVote(id, preVote)
+	}
+}
+
+// poll records a grant/reject from id and returns the number of grants seen
+// so far.
+func (r *Raft) poll(id uint64, grant bool) (granted int) {
+	if grant {
+		r.votes[id] = true
+	} else if _, ok := r.votes[id]; !ok {
+		r.votes[id] = false
+	}
+	for _, v := range r.votes {
+		if v {
+			granted++
+		}
+	}
+	return granted
+}
+
+// handleVoteResponse processes a MsgRequestVoteResponse (preVote == false) or
+// MsgPreVoteResponse (preVote == true).
+func (r *Raft) handleVoteResponse(m pb.Message, preVote bool) {
+	if preVote && r.State != StatePreCandidate {
+		return
+	}
+	if !preVote && r.State != StateCandidate {
+		return
+	}
+	r.poll(m.From, !m.Reject)
+	incGranted, incRejected := tallyVotes(r.votes, r.Prs)
+	won := incGranted >= r.quorum()
+	lost := incRejected >= r.quorum()
+	if r.isJoint() {
+		// Joint consensus: winning requires a majority of both the incoming
+		// and the outgoing voter set; losing either majority's worth of
+		// rejections means we cannot win no matter what the other set does.
+		outGranted, outRejected := tallyVotes(r.votes, r.votersOutgoing)
+		outQuorum := len(r.votersOutgoing)/2 + 1
+		won = won && outGranted >= outQuorum
+		lost = lost || outRejected >= outQuorum
+	}
+	switch {
+	case won:
+		if preVote {
+			r.campaign(false)
+		} else {
+			r.becomeLeader()
+		}
+	case lost:
+		// This peer could not have won the election, go back to being a
+		// follower so it stops disrupting the cluster.
+		r.becomeFollower(r.Term, None)
+	}
+}
+
+// tallyVotes counts, among the members of ids, how many votes have recorded
+// a grant or a reject.
+func tallyVotes(votes map[uint64]bool, ids map[uint64]*Progress) (granted, rejected int) {
+	for id := range ids {
+		v, ok := votes[id]
+		if !ok {
+			continue
+		}
+		if v {
+			granted++
+		} else {
+			rejected++
+		}
+	}
+	return granted, rejected
+}
+
+// handleVoteRequest processes a MsgRequestVote or MsgPreVote.
+func (r *Raft) handleVoteRequest(m pb.Message) {
+	preVote := m.MsgType == pb.MessageType_MsgPreVote
+
+	// Leader lease: if we have heard from our leader recently — whether we
+	// are that leader, or a follower of it — reject the (pre-)vote outright
+	// instead of granting it to a challenger. This is what protects a
+	// healthy leader from a minority partition that keeps rejoining and
+	// forcing elections: pre-votes must be covered too, since a challenger
+	// that cannot even win a pre-vote round never starts a real election.
+	if r.CheckQuorum && r.Lead != None && r.electionElapsed < r.electionTimeout {
+		r.sendRequestVoteResponse(m.From, preVote, true)
+		return
+	}
+
+	index := r.RaftLog.LastIndex()
+	logTerm, _ := r.RaftLog.Term(index)
+	upToDate := m.LogTerm > logTerm || (m.LogTerm == logTerm && m.Index >= index)
+	if !upToDate {
+		r.sendRequestVoteResponse(m.From, preVote, true)
+		return
+	}
+
+	canVote := r.Vote == m.From ||
+		(r.Vote == None && r.Lead == None) ||
+		(preVote && m.Term > r.Term)
+	if !canVote {
+		r.sendRequestVoteResponse(m.From, preVote, true)
+		return
+	}
+
+	if r.State == StateLeader && !preVote {
+		r.State = StateFollower
+	}
+	if !preVote {
+		r.Vote = m.From
+	}
+	r.sendRequestVoteResponse(m.From, preVote, false)
+}
+
+// checkQuorumActive steps down to Follower if this leader has not heard from
+// a quorum of the cluster (including itself) during the last election
+// interval, and otherwise resets every peer's RecentActive flag for the next
+// interval.
+func (r *Raft) checkQuorumActive() {
+	active := 0
+	for _, pr := range r.Prs {
+		if pr.RecentActive {
+			active++
+		}
+	}
+	ok := active >= r.quorum()
+	if r.isJoint() {
+		activeOut := 0
+		for _, pr := range r.votersOutgoing {
+			if pr.RecentActive {
+				activeOut++
+			}
+		}
+		ok = ok && activeOut >= len(r.votersOutgoing)/2+1
+	}
+	for _, id := range r.allVoterIDs() {
+		r.progress(id).RecentActive = false
+	}
+	if pr := r.progress(r.id); pr != nil {
+		// pr is nil once we are no longer a member of any set, e.g. after
+		// removing ourselves and leaving the joint configuration.
+		pr.RecentActive = true
+	}
+	if !ok {
+		r.becomeFollower(r.Term, None)
 	}
 }
 
@@ -343,49 +1158,98 @@ func (r *Raft) VotedFrom(from uint64) {
 // on `eraftpb.proto` for what msgs should be handled
 func (r *Raft) Step(m pb.Message) error {
 	// Your Code Here (2A).
-	if r.Term < m.Term {
-		r.becomeFollower(m.Term, m.From)
-		r.Vote = None
+	if m.Term > r.Term {
+		switch m.MsgType {
+		case pb.MessageType_MsgPreVote:
+			// Pre-votes never cause a term bump: the sender has not
+			// committed to starting a real election yet.
+		case pb.MessageType_MsgPreVoteResponse:
+			if !m.Reject {
+				// A stale pre-vote response for a would-be higher term,
+				// also does not bump our term.
+				break
+			}
+			r.becomeFollower(m.Term, None)
+		case pb.MessageType_MsgAppend, pb.MessageType_MsgHeartbeat, pb.MessageType_MsgSnapshot:
+			r.becomeFollower(m.Term, m.From)
+		case pb.MessageType_MsgRequestVote:
+			// Leader lease: a higher term alone must not force a step-down
+			// here, or handleVoteRequest's lease check below would never
+			// get a chance to run (it would see r.Lead == None and grant).
+			// Mirror etcd: drop the request outright if we've heard from
+			// our leader recently.
+			if r.CheckQuorum && r.Lead != None && r.electionElapsed < r.electionTimeout {
+				return nil
+			}
+			r.becomeFollower(m.Term, None)
+		default:
+			r.becomeFollower(m.Term, None)
+		}
+	}
+
+	if m.From != r.id {
+		if pr := r.progress(m.From); pr != nil {
+			pr.RecentActive = true
+		}
 	}
 
 	switch m.MsgType {
 	case pb.MessageType_MsgHup:
-		if r.State == StateLeader {
+		if r.State == StateLeader || r.isLearner {
 			return nil
 		}
-		r.becomeCandidate()
-		for i, _ := range r.Prs {
-			if i != r.id {
-				r.sendRequestVote(i)
-			}
-		}
+		r.campaign(r.PreVote)
 	case pb.MessageType_MsgBeat:
 		if r.State != StateLeader {
 			return nil
 		}
-		for i, _ := range r.Prs {
-			r.sendHeartbeat(i)
+		for _, i := range r.allVoterIDs() {
+			r.sendHeartbeat(i, nil)
+		}
+		for i, _ := range r.LearnerPrs {
+			r.sendHeartbeat(i, nil)
 		}
 	case pb.MessageType_MsgPropose:
 		if r.State != StateLeader {
 			return nil
 		}
+		for _, e := range m.Entries {
+			if e.EntryType == pb.EntryType_EntryConfChangeV2 && r.PendingConfIndex > r.RaftLog.applied {
+				// Another conf change is still in flight (proposed but not
+				// yet applied). Drop the whole proposal so the caller knows
+				// its membership change was rejected, instead of silently
+				// committing a no-op in its place.
+				return ErrProposalDropped
+			}
+		}
 		for _, e := range m.Entries {
 			e.Index = r.RaftLog.LastIndex() + 1
 			e.Term = r.Term
+			if e.EntryType == pb.EntryType_EntryConfChangeV2 {
+				r.PendingConfIndex = e.Index
+			}
 			r.RaftLog.entries = append(r.RaftLog.entries, *e)
 		}
-		for i, _ := range r.Prs {
+		if pr := r.progress(r.id); pr != nil {
+			// The leader never sends itself an append, so nothing else
+			// advances its own Match; without this it is silently excluded
+			// from its own commit quorum.
+			pr.maybeUpdate(r.RaftLog.LastIndex())
+		}
+		for _, i := range r.allVoterIDs() {
 			if i == r.id {
 				continue
 			}
 			r.sendAppend(i)
 		}
-		if len(r.Prs) == 1 {
+		for i, _ := range r.LearnerPrs {
+			r.sendAppend(i)
+		}
+		if !r.isJoint() && len(r.Prs) == 1 {
 			r.RaftLog.committed = r.RaftLog.LastIndex()
 		}
 	case pb.MessageType_MsgAppend:
-		if r.Term <= m.Term {
+		if r.State == StateCandidate || r.State == StatePreCandidate {
 			r.becomeFollower(m.Term, m.From)
 		}
 		if logTerm, _ := r.RaftLog.Term(m.Index); logTerm != m.LogTerm {
@@ -394,6 +1258,10 @@ func (r *Raft) Step(m pb.Message) error {
 				To: m.From,
 				From: m.To,
 				Term: r.Term,
+				// Index carries a hint: the last index of our log, so when
+				// our log is shorter the leader can jump back to it instead
+				// of backing off one entry at a time.
+				Index: r.RaftLog.LastIndex(),
 				Reject: true,
 			})
 			return nil
@@ -417,55 +1285,197 @@ func (r *Raft) Step(m pb.Message) error {
 			To: m.From,
 			From: m.To,
 			Term: r.Term,
+			Index: r.RaftLog.LastIndex(),
 			Reject: false,
 		})
 	case pb.MessageType_MsgAppendResponse:
 		if r.State != StateLeader {
 			return nil
 		}
-		resort := r.Prs[m.From].Match <= r.RaftLog.committed && m.Index > r.RaftLog.committed
-		r.Prs[m.From].Match = m.Index
-		if resort {
-			match := make(uint64Slice, len(r.Prs))
-			j := 0
-			for i := range r.Prs {
-				match[j] = r.Prs[i].Match
-				j++
+		pr := r.progress(m.From)
+		if pr == nil {
+			return nil
+		}
+		pr.RecentActive = true
+		pr.Paused = false
+		if m.Reject {
+			if pr.maybeDecrTo(m.Index) {
+				r.sendAppend(m.From)
 			}
-			sort.Sort(match)
-			r.RaftLog.committed = match[(len(r.Prs) + 1) / 2]
-		}
-	case pb.MessageType_MsgRequestVote:
-		index := r.RaftLog.LastIndex()
-		logTerm, _ := r.RaftLog.Term(index)
-		if logTerm > m.LogTerm || logTerm == m.LogTerm && index > m.Index {
-			r.sendRequestVoteResponse(m.From, true)
 			return nil
 		}
-		if r.State == StateLeader {
-			r.State = StateFollower
+
+		isVoter := r.Prs[m.From] != nil || r.votersOutgoing[m.From] != nil
+		resort := pr.Match <= r.RaftLog.committed && m.Index > r.RaftLog.committed && isVoter
+		if pr.maybeUpdate(m.Index) {
+			switch pr.State {
+			case ProgressStateProbe:
+				pr.becomeReplicate()
+			case ProgressStateSnapshot:
+				if pr.Match >= pr.PendingSnapshot {
+					pr.becomeProbe()
+				}
+			case ProgressStateReplicate:
+				pr.ins.freeTo(m.Index)
+			}
 		}
-		switch r.Vote {
-		case None:
-			r.Vote = m.From
-			fallthrough
-		case m.From:
-			r.sendRequestVoteResponse(m.From, false)
-		default:
-			r.sendRequestVoteResponse(m.From, true)
+		if resort {
+			// Quorum (and thus the commit index) is computed from Prs (and,
+			// while a joint-consensus change is in flight, votersOutgoing
+			// too): learners replicate the log but are never counted
+			// towards it.
+			r.RaftLog.committed = r.committedIndex()
 		}
+		// The ack may have freed room in the window, or moved us out of
+		// Probe; either way there may be more to send now.
+		r.sendAppend(m.From)
+	case pb.MessageType_MsgRequestVote, pb.MessageType_MsgPreVote:
+		r.handleVoteRequest(m)
 	case pb.MessageType_MsgRequestVoteResponse:
-		if !m.Reject && !r.votes[m.From] {
-			r.VotedFrom(m.From)
-		}
+		r.handleVoteResponse(m, false)
+	case pb.MessageType_MsgPreVoteResponse:
+		r.handleVoteResponse(m, true)
 	case pb.MessageType_MsgHeartbeat:
-		if r.Term <= m.Term {
+		if r.State == StateCandidate || r.State == StatePreCandidate {
 			r.becomeFollower(m.Term, m.From)
 		}
+		if r.State != StateLeader {
+			r.Lead = m.From
+			r.electionElapsed = 0
+			resp := pb.Message {
+				MsgType: pb.MessageType_MsgHeartbeatResponse,
+				To: m.From,
+				From: m.To,
+				Term: r.Term,
+			}
+			if len(m.Entries) > 0 {
+				resp.Entries = m.Entries
+			}
+			r.msgs = append(r.msgs, resp)
+		}
+	case pb.MessageType_MsgHeartbeatResponse:
+		if r.State != StateLeader {
+			return nil
+		}
+		pr := r.progress(m.From)
+		if pr != nil {
+			pr.RecentActive = true
+			if pr.Match < r.RaftLog.LastIndex() {
+				r.sendAppend(m.From)
+			}
+		}
+		if len(m.Entries) == 0 {
+			return nil
+		}
+		r.handleReadIndexAck(m)
+	case pb.MessageType_MsgReadIndex:
+		if r.State != StateLeader {
+			if r.Lead == None {
+				// No known leader to forward to; drop the request.
+				return nil
+			}
+			m.To = r.Lead
+			// Mark ourselves as the originator so the leader's
+			// appendReadState routes the eventual MsgReadIndexResp back to
+			// us instead of treating the request as its own.
+			m.From = r.id
+			r.msgs = append(r.msgs, m)
+			return nil
+		}
+		if len(m.Entries) == 0 {
+			return nil
+		}
+		if committedTerm, err := r.RaftLog.Term(r.RaftLog.committed); err != nil || committedTerm != r.Term {
+			// We haven't committed anything in our own term yet (e.g. right
+			// after an election): r.RaftLog.committed may still reflect a
+			// prior leader's log, so a read confirmed against it would not
+			// be linearizable. Drop the request; the caller is expected to
+			// retry once our term's noop has committed.
+			return nil
+		}
+		if r.readOnly.option == ReadOnlyLeaseBased && r.CheckQuorum {
+			// We still hold the lease: no need to round-trip a heartbeat.
+			r.appendReadState(m, r.RaftLog.committed)
+			return nil
+		}
+		r.readOnly.addRequest(r.RaftLog.committed, m)
+		r.bcastHeartbeat(m.Entries[0].Data)
+	case pb.MessageType_MsgReadIndexResp:
+		if len(m.Entries) == 0 {
+			return nil
+		}
+		r.readStates = append(r.readStates, ReadState{Index: m.Index, RequestCtx: m.Entries[0].Data})
 	}
 	return nil
 }
 
+// bcastHeartbeat sends a heartbeat carrying ctx to every voter other than
+// ourselves — the incoming set, and the outgoing set too while a
+// joint-consensus change is in flight — used to confirm a pending ReadIndex
+// request.
+func (r *Raft) bcastHeartbeat(ctx []byte) {
+	for _, id := range r.allVoterIDs() {
+		if id == r.id {
+			continue
+		}
+		r.sendHeartbeat(id, ctx)
+	}
+}
+
+// handleReadIndexAck records that m.From's heartbeat response echoed a
+// pending read index's context, and once a quorum has done so, resolves it
+// (and every read queued ahead of it) either into a local ReadState or a
+// MsgReadIndexResp routed back to whichever follower forwarded it.
+func (r *Raft) handleReadIndexAck(m pb.Message) {
+	ctx := m.Entries[0].Data
+	acks := r.readOnly.recvAck(m.From, ctx)
+	if acks == nil {
+		return
+	}
+	granted := 0
+	for id := range r.Prs {
+		if id == r.id || acks[id] {
+			granted++
+		}
+	}
+	ok := granted >= r.quorum()
+	if r.isJoint() {
+		// A joint-consensus change in flight requires a quorum of the
+		// outgoing voter set too, exactly like vote tallying and
+		// checkQuorumActive.
+		outGranted := 0
+		for id := range r.votersOutgoing {
+			if id == r.id || acks[id] {
+				outGranted++
+			}
+		}
+		ok = ok && outGranted >= len(r.votersOutgoing)/2+1
+	}
+	if !ok {
+		return
+	}
+	for _, rs := range r.readOnly.advance(ctx) {
+		r.appendReadState(rs.req, rs.index)
+	}
+}
+
+// appendReadState resolves req (a MsgReadIndex) confirmed at index: locally
+// if we originated it, or via MsgReadIndexResp back to whoever forwarded it.
+func (r *Raft) appendReadState(req pb.Message, index uint64) {
+	if req.From == None || req.From == r.id {
+		r.readStates = append(r.readStates, ReadState{Index: index, RequestCtx: req.Entries[0].Data})
+		return
+	}
+	r.msgs = append(r.msgs, pb.Message {
+		MsgType: pb.MessageType_MsgReadIndexResp,
+		To: req.From,
+		From: r.id,
+		Term: r.Term,
+		Index: index,
+		Entries: req.Entries,
+	})
+}
+
 // handleAppendEntries handle AppendEntries RPC request
 func (r *Raft) handleAppendEntries(m pb.Message) {
 	// Your Code Here (2A).
@@ -481,12 +1491,121 @@ func (r *Raft) handleSnapshot(m pb.Message) {
 	// Your Code Here (2C).
 }
 
-// addNode add a new node to raft group
+// addNode adds a new voting node to the raft group, or promotes an existing
+// learner to a voter. Promotion moves the Progress entry from LearnerPrs to
+// Prs atomically, preserving the learner's replication state so it does not
+// need to catch up again.
 func (r *Raft) addNode(id uint64) {
 	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; ok {
+		return
+	}
+	if pr, ok := r.LearnerPrs[id]; ok {
+		delete(r.LearnerPrs, id)
+		r.Prs[id] = pr
+		if id == r.id {
+			r.isLearner = false
+		}
+		return
+	}
+	r.Prs[id] = &Progress{Next: r.RaftLog.LastIndex() + 1, ins: newInflights(r.maxInflightMsgs)}
+}
+
+// addLearner adds id to the raft group as a non-voting learner.
+func (r *Raft) addLearner(id uint64) {
+	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; ok {
+		return
+	}
+	if _, ok := r.LearnerPrs[id]; ok {
+		return
+	}
+	r.LearnerPrs[id] = &Progress{Next: r.RaftLog.LastIndex() + 1, ins: newInflights(r.maxInflightMsgs)}
+	if id == r.id {
+		r.isLearner = true
+	}
 }
 
-// removeNode remove a node from raft group
+// removeNode removes a node (voter or learner) from raft group.
 func (r *Raft) removeNode(id uint64) {
 	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; !ok {
+		delete(r.LearnerPrs, id)
+		return
+	}
+	delete(r.Prs, id)
+	// Removing a voter shrinks the quorum size, which may let entries that
+	// were stuck behind the departed peer's Match now commit.
+	r.maybeAdvanceCommitted()
+}
+
+// enterJoint applies changes to the incoming voter set, moving the current
+// incoming set aside as the outgoing set, so commit and voting quorums
+// require a majority of both sets until leaveJoint is called.
+func (r *Raft) enterJoint(changes []ConfChangeSingle) {
+	r.votersOutgoing = make(map[uint64]*Progress, len(r.Prs))
+	for id, pr := range r.Prs {
+		r.votersOutgoing[id] = pr
+	}
+	for _, c := range changes {
+		switch c.Type {
+		case ConfChangeAddNode, ConfChangePromoteLearner:
+			r.addNode(c.NodeID)
+		case ConfChangeAddLearnerNode:
+			r.addLearner(c.NodeID)
+		case ConfChangeRemoveNode:
+			// Dropped from the incoming set immediately; votersOutgoing
+			// keeps its Progress alive until leaveJoint, so it keeps
+			// replicating and voting as part of the old majority for as
+			// long as that majority is still required.
+			delete(r.Prs, c.NodeID)
+			delete(r.LearnerPrs, c.NodeID)
+		}
+	}
+}
+
+// leaveJoint drops the outgoing voter set, finalizing the incoming set (as
+// last modified by enterJoint, or unchanged if we were never joint) as the
+// cluster's sole membership.
+func (r *Raft) leaveJoint() {
+	r.votersOutgoing = nil
+}
+
+// applyConfChange applies a committed ConfChangeV2 entry and returns the
+// resulting membership. An empty cc (no Changes) leaves the joint
+// configuration entered by a prior Explicit-transition change. Any other cc
+// enters a joint configuration and, for Transition == ConfChangeTransitionAuto,
+// leaves it again immediately so the caller never observes an intermediate
+// joint state for a one-shot change. In Explicit mode the leader is
+// responsible for proposing a follow-up empty ConfChangeV2, once this entry
+// is past PendingConfIndex, to leave the joint configuration.
+func (r *Raft) applyConfChange(cc ConfChangeV2) *ConfState {
+	if len(cc.Changes) == 0 {
+		r.leaveJoint()
+	} else {
+		r.enterJoint(cc.Changes)
+		if cc.Transition == ConfChangeTransitionAuto {
+			r.leaveJoint()
+		}
+	}
+	r.maybeAdvanceCommitted()
+	return r.confState()
+}
+
+// confState reports the current voter, outgoing-voter, and learner sets.
+func (r *Raft) confState() *ConfState {
+	cs := &ConfState{}
+	for id := range r.Prs {
+		cs.Voters = append(cs.Voters, id)
+	}
+	for id := range r.votersOutgoing {
+		cs.VotersOutgoing = append(cs.VotersOutgoing, id)
+	}
+	for id := range r.LearnerPrs {
+		cs.Learners = append(cs.Learners, id)
+	}
+	sort.Sort(uint64Slice(cs.Voters))
+	sort.Sort(uint64Slice(cs.VotersOutgoing))
+	sort.Sort(uint64Slice(cs.Learners))
+	return cs
 }